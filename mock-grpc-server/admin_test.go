@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/tkoberle/golang-samples/mock-grpc-server/cachepolicy"
+)
+
+func TestAdminCacheMetricsUnavailableWithoutCache(t *testing.T) {
+	admin := newAdminServer(NewStubStore(), nil)
+	rec := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache-metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminCacheMetricsReportsCounters(t *testing.T) {
+	files := buildTestFiles(t)
+	registry := &MockRegistry{Stubs: NewStubStore(), ResponseTypes: map[string]proto.Message{}, Files: files}
+	policy := cachepolicy.NewPolicy(files)
+	cache := NewCacheMiddleware(registry, policy, files, map[string]cachepolicy.InvalidationGroup{})
+
+	methodDesc := testMethodDesc(t, files)
+	req := dynamicpb.NewMessage(methodDesc.Input())
+	if _, err := cache.Resolve("/testpkg.TestService/Get", methodDesc, req, func() (proto.Message, error) {
+		return dynamicpb.NewMessage(methodDesc.Output()), nil
+	}); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+
+	admin := newAdminServer(NewStubStore(), cache)
+	rec := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cache-metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got cacheMetrics
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if got.Misses != 1 {
+		t.Fatalf("Misses = %d, want 1", got.Misses)
+	}
+}
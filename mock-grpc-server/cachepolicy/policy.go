@@ -0,0 +1,163 @@
+// Package cachepolicy reads the (mock.op_type) method option declared in
+// policy.proto off method descriptors loaded from a FileDescriptorSet, and
+// lets callers register invalidation groups without touching MockRegistry
+// itself.
+package cachepolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// OpType mirrors the mock.OpType enum declared in policy.proto.
+type OpType int32
+
+const (
+	Accessor OpType = 0
+	Mutator  OpType = 1
+)
+
+// opTypeExtensionName is the fully-qualified name of the (mock.op_type)
+// extension declared in policy.proto.
+const opTypeExtensionName protoreflect.FullName = "mock.op_type"
+
+// InvalidationGroup ties a mutator method to the accessor methods whose
+// cached responses it should evict, keyed by a scope value read out of a
+// designated request field shared by the mutator and its accessors (e.g. a
+// "user_id" both sides carry).
+type InvalidationGroup struct {
+	ScopeField string   `json:"scope_field"`
+	Accessors  []string `json:"accessors"` // "service.method" entries sharing ScopeField's scope
+}
+
+// Policy resolves op-types from loaded descriptors and holds
+// mutator->InvalidationGroup registrations.
+type Policy struct {
+	files *protoregistry.Files
+
+	mu     sync.RWMutex
+	groups map[string]InvalidationGroup // "service.method" (mutator) -> group
+	opType map[protoreflect.FullName]OpType
+}
+
+// NewPolicy returns a Policy that resolves method options against files.
+func NewPolicy(files *protoregistry.Files) *Policy {
+	return &Policy{
+		files:  files,
+		groups: make(map[string]InvalidationGroup),
+		opType: make(map[protoreflect.FullName]OpType),
+	}
+}
+
+// RegisterInvalidationGroup associates a mutator method (in "service.method"
+// form) with the accessors it should invalidate.
+func (p *Policy) RegisterInvalidationGroup(mutatorMethod string, group InvalidationGroup) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.groups[mutatorMethod] = group
+}
+
+// InvalidationGroup returns the group registered for a mutator method, if any.
+func (p *Policy) InvalidationGroup(mutatorMethod string) (InvalidationGroup, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	group, ok := p.groups[mutatorMethod]
+	return group, ok
+}
+
+// OpType resolves the (mock.op_type) option declared on methodDesc, defaulting
+// to Accessor when the option is absent (so ordinary methods need no
+// annotation to be treated as safely cacheable reads).
+func (p *Policy) OpType(methodDesc protoreflect.MethodDescriptor) OpType {
+	p.mu.RLock()
+	if op, ok := p.opType[methodDesc.FullName()]; ok {
+		p.mu.RUnlock()
+		return op
+	}
+	p.mu.RUnlock()
+
+	op := p.resolveOpType(methodDesc)
+
+	p.mu.Lock()
+	p.opType[methodDesc.FullName()] = op
+	p.mu.Unlock()
+	return op
+}
+
+func (p *Policy) resolveOpType(methodDesc protoreflect.MethodDescriptor) OpType {
+	desc, err := p.files.FindDescriptorByName(opTypeExtensionName)
+	if err != nil {
+		return Accessor // mock.proto wasn't part of the loaded descriptor set
+	}
+	extDesc, ok := desc.(protoreflect.ExtensionDescriptor)
+	if !ok {
+		return Accessor
+	}
+	extType := dynamicpb.NewExtensionType(extDesc)
+
+	opts, ok := methodDesc.Options().(proto.Message)
+	if !ok || !proto.HasExtension(opts, extType) {
+		return Accessor
+	}
+	value := proto.GetExtension(opts, extType)
+	// A generated Go type (compiled with protoc-gen-go) hands back a named
+	// enum implementing protoreflect.Enum; an extension resolved purely from
+	// a loaded FileDescriptorSet - this package's whole reason for existing,
+	// per the package doc comment - has no such type and hands back a bare
+	// protoreflect.EnumNumber instead. Handle both.
+	switch v := value.(type) {
+	case protoreflect.Enum:
+		return OpType(v.Number())
+	case protoreflect.EnumNumber:
+		return OpType(v)
+	default:
+		return Accessor
+	}
+}
+
+// String renders the name used in policy.proto, for logging.
+func (t OpType) String() string {
+	switch t {
+	case Mutator:
+		return "MUTATOR"
+	default:
+		return "ACCESSOR"
+	}
+}
+
+// LoadInvalidationGroups reads a JSON file mapping mutator "service.method"
+// to InvalidationGroup, so groups can be declared as config rather than Go
+// code. The returned map is suitable for both Policy.RegisterInvalidationGroup
+// and NewCacheMiddleware.
+func LoadInvalidationGroups(path string) (map[string]InvalidationGroup, error) {
+	groups := make(map[string]InvalidationGroup)
+	if path == "" {
+		return groups, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// ScopeKey reads the value of fieldName off req and renders it as a cache
+// scope key, e.g. to correlate a mutator call with the accessor responses it
+// should invalidate.
+func ScopeKey(req protoreflect.Message, fieldName string) (string, bool) {
+	fd := req.Descriptor().Fields().ByName(protoreflect.Name(fieldName))
+	if fd == nil {
+		return "", false
+	}
+	return fmt.Sprint(req.Get(fd).Interface()), true
+}
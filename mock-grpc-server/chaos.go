@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// z99 is the 99th percentile of the standard normal distribution, used to
+// derive a log-normal's sigma from a p50/p99 pair.
+const z99 = 2.326
+
+// LatencyProfile injects delay before a response is served, either a fixed
+// duration or sampled from a log-normal fit to the given percentiles.
+type LatencyProfile struct {
+	FixedMs int     `json:"fixed_ms,omitempty"`
+	P50Ms   float64 `json:"p50_ms,omitempty"`
+	P99Ms   float64 `json:"p99_ms,omitempty"`
+}
+
+// ErrorProfile fails a call with the given gRPC status some fraction of the
+// time.
+type ErrorProfile struct {
+	Rate    float64 `json:"rate"`
+	Code    int32   `json:"code"`
+	Message string  `json:"message"`
+}
+
+// ChaosProfile is the fault-injection configuration for one method or
+// request hash.
+type ChaosProfile struct {
+	Latency                     *LatencyProfile `json:"latency,omitempty"`
+	Error                       *ErrorProfile   `json:"error_rate,omitempty"`
+	AbortAfterBytes             int             `json:"abort_after_bytes,omitempty"`
+	DeadlineExceededProbability float64         `json:"deadline_exceeded_probability,omitempty"`
+}
+
+// LoadChaosProfiles reads a JSON file mapping "service/method" (or a request
+// hash, for unary calls) to a ChaosProfile. Request-hash profiles are only
+// consulted by UnaryServerInterceptor; calls served through
+// grpc.UnknownServiceHandler reach only StreamServerInterceptor, which looks
+// profiles up by "service/method" alone.
+func LoadChaosProfiles(path string) (map[string]*ChaosProfile, error) {
+	profiles := make(map[string]*ChaosProfile)
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// ChaosInjector applies ChaosProfiles to unary and streaming RPCs via
+// interceptors, using a seeded PRNG so runs are reproducible with
+// -chaos-seed.
+type ChaosInjector struct {
+	profiles map[string]*ChaosProfile
+
+	mu  sync.Mutex // *rand.Rand is not safe for concurrent use
+	rng *rand.Rand
+}
+
+// NewChaosInjector returns a ChaosInjector seeded for deterministic replay.
+func NewChaosInjector(profiles map[string]*ChaosProfile, seed int64) *ChaosInjector {
+	return &ChaosInjector{profiles: profiles, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (c *ChaosInjector) sample() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.Float64()
+}
+
+func (c *ChaosInjector) normal() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng.NormFloat64()
+}
+
+// profileFor looks up a method's profile first by "service/method" (e.g.
+// "pkg.Service/Method"), falling back to a request hash when req is available
+// (unary calls only).
+func (c *ChaosInjector) profileFor(fullMethod string, req proto.Message) (*ChaosProfile, bool) {
+	service, method := splitFullMethod(fullMethod)
+	if p, ok := c.profiles[service+"/"+method]; ok {
+		return p, true
+	}
+	if req != nil {
+		if p, ok := c.profiles[requestHash(req)]; ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func (c *ChaosInjector) delayFor(profile *LatencyProfile) time.Duration {
+	if profile.FixedMs > 0 {
+		return time.Duration(profile.FixedMs) * time.Millisecond
+	}
+	if profile.P50Ms <= 0 || profile.P99Ms <= 0 {
+		return 0
+	}
+	mu := math.Log(profile.P50Ms)
+	sigma := (math.Log(profile.P99Ms) - mu) / z99
+	sampleMs := math.Exp(mu + sigma*c.normal())
+	return time.Duration(sampleMs * float64(time.Millisecond))
+}
+
+// apply injects latency and, if the profile calls for it, a synthetic
+// failure. It returns the failure as an error so interceptors can abort the
+// call before (or instead of) dispatching to the real handler.
+func (c *ChaosInjector) apply(ctx context.Context, profile *ChaosProfile) error {
+	if profile.Latency != nil {
+		if delay := c.delayFor(profile.Latency); delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	if profile.DeadlineExceededProbability > 0 && c.sample() < profile.DeadlineExceededProbability {
+		return status.Error(codes.DeadlineExceeded, "chaos: synthetic deadline exceeded")
+	}
+	if profile.Error != nil && c.sample() < profile.Error.Rate {
+		return status.Error(codes.Code(profile.Error.Code), profile.Error.Message)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor injects latency/errors configured for the dispatched
+// method or, failing that, for the request's hash.
+func (c *ChaosInjector) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		reqMsg, _ := req.(proto.Message)
+		if profile, ok := c.profileFor(info.FullMethod, reqMsg); ok {
+			if err := c.apply(ctx, profile); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor injects latency/errors configured for the
+// dispatched method (request-hash profiles aren't available until the first
+// message arrives, so they don't apply to streams) and wraps SendMsg to
+// honor AbortAfterBytes.
+func (c *ChaosInjector) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		profile, ok := c.profileFor(info.FullMethod, nil)
+		if !ok {
+			return handler(srv, ss)
+		}
+		if err := c.apply(ss.Context(), profile); err != nil {
+			return err
+		}
+		return handler(srv, &chaosServerStream{ServerStream: ss, profile: profile})
+	}
+}
+
+// chaosServerStream aborts a stream once AbortAfterBytes have been sent.
+type chaosServerStream struct {
+	grpc.ServerStream
+	profile   *ChaosProfile
+	bytesSent int
+}
+
+func (s *chaosServerStream) SendMsg(m interface{}) error {
+	if s.profile.AbortAfterBytes > 0 {
+		switch msg := m.(type) {
+		case *rawFrame: // the dynamic handlers send pre-marshaled frames
+			s.bytesSent += len(msg.payload)
+		case proto.Message:
+			b, err := proto.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			s.bytesSent += len(b)
+		}
+		if s.bytesSent > s.profile.AbortAfterBytes {
+			return status.Errorf(codes.Aborted, "chaos: aborted stream after %d bytes", s.profile.AbortAfterBytes)
+		}
+	}
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// LoadDescriptorSet reads a google.protobuf.FileDescriptorSet, as produced by
+// `protoc --descriptor_set_out=out.pb --include_imports`, and builds a
+// protoregistry.Files from it. This lets the mock server reason about
+// services and messages it was never compiled against.
+func LoadDescriptorSet(path string) (*protoregistry.Files, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %w", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("building file registry from %s: %w", path, err)
+	}
+	return files, nil
+}
+
+// RegisterDynamicTypes walks every message declared in files and adds a
+// dynamicpb template for it to r.ResponseTypes, keyed by fully-qualified
+// message name, so stubs and the legacy hash mapping can address messages
+// that have no generated Go type.
+func (r *MockRegistry) RegisterDynamicTypes(files *protoregistry.Files) {
+	if r.ResponseTypes == nil {
+		r.ResponseTypes = make(map[string]proto.Message)
+	}
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		registerMessagesRecursive(r.ResponseTypes, fd.Messages())
+		return true
+	})
+}
+
+func registerMessagesRecursive(dst map[string]proto.Message, messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		dst[string(md.FullName())] = dynamicpb.NewMessage(md)
+		registerMessagesRecursive(dst, md.Messages())
+	}
+}
+
+// findMethodDescriptor resolves a "/pkg.Service/Method" pair against a
+// protoregistry.Files built from a loaded descriptor set.
+func findMethodDescriptor(files *protoregistry.Files, service, method string) (protoreflect.MethodDescriptor, error) {
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("unknown service %q: %w", service, err)
+	}
+	svcDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a service", service)
+	}
+	methodDesc := svcDesc.Methods().ByName(protoreflect.Name(method))
+	if methodDesc == nil {
+		return nil, fmt.Errorf("unknown method %q on service %q", method, service)
+	}
+	return methodDesc, nil
+}
+
+// rawFrame is a grpc message frame that carries undecoded wire bytes. It lets
+// the server accept requests for methods it has no generated Go type for.
+type rawFrame struct {
+	payload []byte
+}
+
+func (f *rawFrame) Marshal() ([]byte, error) {
+	return f.payload, nil
+}
+
+func (f *rawFrame) Unmarshal(data []byte) error {
+	f.payload = data
+	return nil
+}
+
+// rawCodecName is the gRPC content-subtype ("application/grpc+<name>")
+// dynamic-mock clients must request - via grpc.CallContentSubtype(rawCodecName)
+// on the dial/call options, since this binary has no generated client stubs
+// of its own - to have their frames pass through this codec as raw bytes
+// instead of being decoded into a concrete proto message.
+//
+// This is deliberately NOT "proto", grpc-go's default codec name: registering
+// under the default would hijack every call on the process, including any
+// compiled-stub service registered on the same grpc.Server (the pattern the
+// commented-out example in mock-grpc-server.go's main() shows), and rawCodec.Unmarshal's
+// v.(*rawFrame) assertion would then panic on that service's first call.
+const rawCodecName = "mock-raw"
+
+// rawCodec lets the server accept requests for methods it has no generated
+// Go type for, by passing frames through as raw bytes under rawCodecName
+// instead of decoding them. It must be registered before the server starts
+// serving.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.(*rawFrame).Marshal()
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	return v.(*rawFrame).Unmarshal(data)
+}
+
+func (rawCodec) Name() string {
+	return rawCodecName
+}
+
+func init() {
+	encoding.RegisterCodec(rawCodec{})
+}
+
+// DynamicUnknownServiceHandler builds a grpc.UnknownServiceHandler that
+// serves any method described by files out of registry. It dispatches on the
+// method's streaming shape (unary, server-streaming, client-streaming, or
+// bidi) and unmarshals/marshals requests and responses as dynamicpb messages
+// so it works without any generated Go stubs. Callers must dial or call with
+// grpc.CallContentSubtype(rawCodecName) so grpc-go routes their frames
+// through rawCodec instead of trying (and failing) to decode them with the
+// default "proto" codec.
+// cache, if non-nil, is applied to unary calls the same way
+// CacheMiddleware.UnaryServerInterceptor applies it for classically-registered
+// services - see that method's doc comment for why the interceptor alone
+// isn't enough here. Client-streaming and bidi mutators are invalidated the
+// same way, directly in serveClientStream/serveBidi, since
+// CacheMiddleware.StreamServerInterceptor's invalidatingServerStream can't
+// see through this handler's *rawFrame messages either.
+func DynamicUnknownServiceHandler(registry *MockRegistry, files *protoregistry.Files, cache *CacheMiddleware) func(srv interface{}, stream grpc.ServerStream) error {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		fullMethod, ok := grpc.MethodFromServerStream(stream)
+		if !ok {
+			return status.Error(codes.Internal, "could not determine method from stream")
+		}
+		service, method := splitFullMethod(fullMethod)
+
+		methodDesc, err := findMethodDescriptor(files, service, method)
+		if err != nil {
+			return status.Error(codes.Unimplemented, err.Error())
+		}
+
+		switch {
+		case methodDesc.IsStreamingClient() && methodDesc.IsStreamingServer():
+			return serveBidi(registry, methodDesc, fullMethod, stream, cache)
+		case methodDesc.IsStreamingServer():
+			return serveServerStream(registry, methodDesc, fullMethod, stream)
+		case methodDesc.IsStreamingClient():
+			return serveClientStream(registry, methodDesc, fullMethod, stream, cache)
+		default:
+			return serveUnary(registry, methodDesc, fullMethod, stream, cache)
+		}
+	}
+}
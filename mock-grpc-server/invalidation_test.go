@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/tkoberle/golang-samples/mock-grpc-server/cachepolicy"
+)
+
+// invokeDynamic makes a real RPC against fullMethod, the way a client with no
+// generated stub for it would: requesting rawCodecName so grpc-go routes the
+// frames through rawCodec instead of trying (and failing) to decode them
+// with its default codec.
+func invokeDynamic(t *testing.T, conn *grpc.ClientConn, fullMethod string, req, resp proto.Message) {
+	t.Helper()
+	reqBytes, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("marshal request: %v", err)
+	}
+	var respFrame rawFrame
+	if err := conn.Invoke(context.Background(), fullMethod, &rawFrame{payload: reqBytes}, &respFrame); err != nil {
+		t.Fatalf("invoking %s: %v", fullMethod, err)
+	}
+	if err := proto.Unmarshal(respFrame.payload, resp); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+}
+
+// TestDynamicUnaryCachingViaRealHandler proves accessor caching actually
+// runs for a unary call served through the real DynamicUnknownServiceHandler
+// wiring - not just by calling CacheMiddleware.UnaryServerInterceptor
+// directly, which grpc-go never invokes for methods served through
+// grpc.UnknownServiceHandler (see CacheMiddleware.UnaryServerInterceptor's
+// doc comment).
+func TestDynamicUnaryCachingViaRealHandler(t *testing.T) {
+	files := buildTestFiles(t)
+	methodDesc := testMethodDesc(t, files)
+	fullMethod := "/testpkg.TestService/Get"
+
+	registry := &MockRegistry{Stubs: NewStubStore(), ResponseTypes: map[string]proto.Message{}, Files: files}
+	registry.RegisterDynamicTypes(files)
+	registry.Stubs.Add(&Stub{
+		Service: "testpkg.TestService",
+		Method:  "Get",
+		Output:  StubOutput{Data: json.RawMessage(`{"msg":"hello"}`)},
+	})
+
+	policy := cachepolicy.NewPolicy(files)
+	cache := NewCacheMiddleware(registry, policy, files, map[string]cachepolicy.InvalidationGroup{})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(DynamicUnknownServiceHandler(registry, files, cache)))
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rawCodecName)),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	req := dynamicpb.NewMessage(methodDesc.Input())
+	req.Set(methodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString("abc"))
+
+	resp1 := dynamicpb.NewMessage(methodDesc.Output())
+	invokeDynamic(t, conn, fullMethod, req, resp1)
+	if got := resp1.Get(methodDesc.Output().Fields().ByName("msg")).String(); got != "hello" {
+		t.Fatalf("resp1.msg = %q, want %q", got, "hello")
+	}
+	if hits, misses, _ := cache.Metrics(); hits != 0 || misses != 1 {
+		t.Fatalf("after first call: hits=%d misses=%d, want hits=0 misses=1", hits, misses)
+	}
+
+	resp2 := dynamicpb.NewMessage(methodDesc.Output())
+	invokeDynamic(t, conn, fullMethod, req, resp2)
+	if hits, misses, _ := cache.Metrics(); hits != 1 || misses != 1 {
+		t.Fatalf("after second (identical) call: hits=%d misses=%d, want hits=1 misses=1", hits, misses)
+	}
+}
@@ -4,18 +4,29 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/tkoberle/golang-samples/mock-grpc-server/cachepolicy"
 )
 
 // MockRegistry holds the request hash to response file mapping
@@ -23,7 +34,13 @@ type MockRegistry struct {
 	Mapping       map[string]string
 	ResponseDir   string
 	ResponseTypes map[string]proto.Message
-	cache         sync.Map // Cache for previously seen requests
+	Stubs         *StubStore
+	Files         *protoregistry.Files     // optional, set when mocking via a loaded FileDescriptorSet
+	StreamMapping map[string]StreamMapping // hash -> ordered server-streaming responses
+	BidiScripts   map[string]*BidiScript   // "service.method" -> scripted bidi exchange
+	cache         sync.Map                 // Cache for previously seen requests
+
+	mappingMu sync.RWMutex // guards Mapping, which -record mode mutates concurrently with reads from every RPC
 }
 
 // LoadRegistry loads the mapping file and initializes the registry
@@ -36,23 +53,45 @@ func LoadRegistry(mappingFilePath, responseDir string, responseTypes map[string]
 	if err := json.Unmarshal(data, &mapping); err != nil {
 		return nil, err
 	}
-	return &MockRegistry{Mapping: mapping, ResponseDir: responseDir, ResponseTypes: responseTypes}, nil
+	return &MockRegistry{Mapping: mapping, ResponseDir: responseDir, ResponseTypes: responseTypes, Stubs: NewStubStore()}, nil
 }
 
-// GetResponse retrieves a mocked response for a given request
-func (r *MockRegistry) GetResponse(req proto.Message) (proto.Message, error) {
+// GetResponse retrieves a mocked response for a given request. fullMethod is
+// the gRPC method in "/pkg.Service/Method" form, as seen on the stream; it is
+// used to look up stub declarations. The stub matcher engine is tried first,
+// falling back to the legacy request-hash mapping for backward compatibility.
+func (r *MockRegistry) GetResponse(ctx context.Context, fullMethod string, req proto.Message) (proto.Message, error) {
 	jsonBytes, err := protojson.MarshalOptions{
 		EmitUnpopulated: true,
 	}.Marshal(req)
 	if err != nil {
 		return nil, err
 	}
+
+	if r.Stubs != nil {
+		service, method := splitFullMethod(fullMethod)
+		fields := flattenJSONFields(jsonBytes)
+		md, _ := metadata.FromIncomingContext(ctx)
+		if stub, ok := r.Stubs.Match(service, method, fields, md); ok {
+			return stubResponse(stub, r.outputTypeFor(service, method))
+		}
+	}
+
 	hash := fmt.Sprintf("%x", sha256.Sum256(jsonBytes))
+	return r.responseFromHash(hash)
+}
+
+// responseFromHash resolves a response from the legacy hash->file Mapping,
+// consulting (and populating) the cache. It is shared by GetResponse and by
+// GetClientStreamResponse, which hashes the concatenation of a whole stream.
+func (r *MockRegistry) responseFromHash(hash string) (proto.Message, error) {
 	if val, ok := r.cache.Load(hash); ok {
 		return val.(proto.Message), nil
 	}
 
+	r.mappingMu.RLock()
 	responseFile, ok := r.Mapping[hash]
+	r.mappingMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("no mock response found for hash: %s", hash)
 	}
@@ -78,13 +117,117 @@ func (r *MockRegistry) GetResponse(req proto.Message) (proto.Message, error) {
 	return response, nil
 }
 
-// inferTypeName infers the type name from the response file name (basic version)
+// outputTypeFor resolves the response message template for a service/method
+// pair declared via ResponseTypes, falling back to a dynamicpb template
+// built from r.Files when a FileDescriptorSet is in use.
+func (r *MockRegistry) outputTypeFor(service, method string) proto.Message {
+	if t, ok := r.ResponseTypes[service+"."+method]; ok {
+		return t
+	}
+	if r.Files == nil {
+		return nil
+	}
+	methodDesc, err := findMethodDescriptor(r.Files, service, method)
+	if err != nil {
+		return nil
+	}
+	return dynamicpb.NewMessage(methodDesc.Output())
+}
+
+// flattenJSONFields decodes a protojson-marshaled message into a flat
+// string-keyed map for FieldMatcher, stringifying each top-level value
+// independently instead of unmarshaling straight into map[string]string
+// (which fails outright the instant any field isn't itself a JSON string -
+// an int32, bool, enum, nested message, or repeated field, i.e. most real
+// proto requests). Non-string values are rendered as their JSON encoding, so
+// equals/contains/matches still see something sensible for scalars
+// (3, true) and a best-effort JSON blob for anything nested.
+func flattenJSONFields(jsonBytes []byte) map[string]string {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(jsonBytes, &raw); err != nil {
+		return nil // request isn't a flat object; equals/contains/matches just won't match anything
+	}
+	fields := make(map[string]string, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			fields[k] = s
+			continue
+		}
+		fields[k] = string(v)
+	}
+	return fields
+}
+
+// splitFullMethod splits a gRPC "/pkg.Service/Method" string into its
+// service and method parts.
+func splitFullMethod(fullMethod string) (service, method string) {
+	trimmed := strings.TrimPrefix(fullMethod, "/")
+	parts := strings.SplitN(trimmed, "/", 2)
+	if len(parts) != 2 {
+		return trimmed, ""
+	}
+	return parts[0], parts[1]
+}
+
+// stubResponse renders a matched stub's output, cloning typeTemplate for
+// successful responses so callers get a fresh message each time.
+func stubResponse(stub *Stub, typeTemplate proto.Message) (proto.Message, error) {
+	out := stub.Output
+	if out.Error != nil {
+		return nil, status.Error(codes.Code(out.Error.Code), out.Error.Message)
+	}
+	if typeTemplate == nil {
+		return nil, fmt.Errorf("no response type registered for stub %s/%s", stub.Service, stub.Method)
+	}
+	response := proto.Clone(typeTemplate)
+	if err := protojson.Unmarshal(out.Data, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// inferTypeName infers the type name from a "<hash>.<type>.json" response
+// file name, recordResponse's naming convention: the hash is a hex digest
+// (never contains '.'), so everything after its first '.' up to the
+// extension is the type name - which itself may contain dots, since
+// RegisterDynamicTypes keys ResponseTypes by fully-qualified message name
+// (e.g. "testpkg.Resp"). Stripping only the extension, as a naive
+// filepath.Ext trim would, left the hash glued onto the front of every
+// package-qualified type name, so responseFromHash could never find it.
 func inferTypeName(filename string) string {
 	base := filepath.Base(filename)
-	return base[:len(base)-len(filepath.Ext(base))] // strip extension
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	if _, typeName, ok := strings.Cut(base, "."); ok {
+		return typeName
+	}
+	return base
 }
 
 func main() {
+	stubDir := flag.String("stub-dir", "", "directory of stub declaration files (JSON/YAML) to load at startup")
+	adminAddr := flag.String("admin-addr", ":8080", "address for the stub admin HTTP endpoint")
+	descriptorSet := flag.String("descriptor-set", "", "path to a FileDescriptorSet (protoc --descriptor_set_out --include_imports) to mock services without generated Go stubs")
+	mappingFile := flag.String("mapping-file", "mapping.json", "hash->response-file mapping, loaded at startup and appended to in -record mode")
+	responseDir := flag.String("response-dir", "responses", "directory holding golden response files named by the mapping")
+	record := flag.Bool("record", false, "proxy unmatched requests to -upstream, capture the response as a golden file, and append it to -mapping-file")
+	replay := flag.Bool("replay", false, "serve purely from -mapping-file/-response-dir (the default; mutually exclusive with -record)")
+	upstream := flag.String("upstream", "", "host:port of the real gRPC service to proxy to in -record mode")
+	invalidationGroups := flag.String("invalidation-groups", "", "JSON file of mutator->InvalidationGroup entries for cache invalidation (requires -descriptor-set)")
+	chaosProfiles := flag.String("chaos-profiles", "", "JSON file mapping service/method (or request hash) to a fault-injection ChaosProfile")
+	chaosSeed := flag.Int64("chaos-seed", 1, "seed for the chaos PRNG, for deterministic reproduction of injected faults")
+	flag.Parse()
+
+	if *record && *replay {
+		log.Fatal("-record and -replay are mutually exclusive")
+	}
+	if *record && *upstream == "" {
+		log.Fatal("-record requires -upstream=host:port")
+	}
+	if *record && *descriptorSet == "" {
+		log.Fatal("-record requires -descriptor-set so captured messages can be decoded and replayed")
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
@@ -92,9 +235,82 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	grpcServer := grpc.NewServer()
 
-	// Example: mypb.RegisterMyServiceServer(grpcServer, &MyMockServer{})
+	stubs := NewStubStore()
+	if *stubDir != "" {
+		if err := stubs.LoadDir(*stubDir); err != nil {
+			log.Fatalf("failed to load stubs from %s: %v", *stubDir, err)
+		}
+	}
+	mapping, err := loadMappingFile(*mappingFile)
+	if err != nil {
+		log.Fatalf("failed to load mapping file %s: %v", *mappingFile, err)
+	}
+	registry := &MockRegistry{Stubs: stubs, ResponseTypes: map[string]proto.Message{}, Mapping: mapping, ResponseDir: *responseDir}
+
+	var serverOpts []grpc.ServerOption
+	var cacheMiddleware *CacheMiddleware // set below when -descriptor-set enables cache invalidation
+	if *descriptorSet != "" {
+		files, err := LoadDescriptorSet(*descriptorSet)
+		if err != nil {
+			log.Fatalf("failed to load descriptor set %s: %v", *descriptorSet, err)
+		}
+		registry.Files = files
+		registry.RegisterDynamicTypes(files)
+
+		groups, err := cachepolicy.LoadInvalidationGroups(*invalidationGroups)
+		if err != nil {
+			log.Fatalf("failed to load invalidation groups %s: %v", *invalidationGroups, err)
+		}
+		policy := cachepolicy.NewPolicy(files)
+		for mutatorMethod, group := range groups {
+			policy.RegisterInvalidationGroup(mutatorMethod, group)
+		}
+		cacheMiddleware = NewCacheMiddleware(registry, policy, files, groups)
+
+		if *record {
+			upstreamConn, err := grpc.Dial(*upstream,
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rawCodecName)),
+			)
+			if err != nil {
+				log.Fatalf("failed to dial upstream %s: %v", *upstream, err)
+			}
+			serverOpts = append(serverOpts, grpc.UnknownServiceHandler(RecordingUnknownServiceHandler(registry, files, upstreamConn, *mappingFile, cacheMiddleware)))
+			log.Printf("Recording unmatched requests to %s, proxying to upstream %s", *responseDir, *upstream)
+		} else {
+			serverOpts = append(serverOpts, grpc.UnknownServiceHandler(DynamicUnknownServiceHandler(registry, files, cacheMiddleware)))
+		}
+
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(cacheMiddleware.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(cacheMiddleware.StreamServerInterceptor()),
+		)
+	}
+
+	if *chaosProfiles != "" {
+		profiles, err := LoadChaosProfiles(*chaosProfiles)
+		if err != nil {
+			log.Fatalf("failed to load chaos profiles %s: %v", *chaosProfiles, err)
+		}
+		chaos := NewChaosInjector(profiles, *chaosSeed)
+		serverOpts = append(serverOpts,
+			grpc.ChainUnaryInterceptor(chaos.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(chaos.StreamServerInterceptor()),
+		)
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
+
+	admin := newAdminServer(stubs, cacheMiddleware)
+	adminServerHTTP := &http.Server{Addr: *adminAddr, Handler: admin.Handler()}
+	go func() {
+		log.Printf("Stub admin endpoint listening on %s", *adminAddr)
+		if err := adminServerHTTP.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("admin endpoint failed: %v", err)
+		}
+	}()
+
+	// Example: mypb.RegisterMyServiceServer(grpcServer, &MyMockServer{Registry: registry})
 
 	go func() {
 		log.Println("Mock gRPC server listening on :50051")
@@ -106,6 +322,7 @@ func main() {
 	<-ctx.Done()
 	log.Println("Shutting down gRPC server...")
 	grpcServer.GracefulStop()
+	adminServerHTTP.Close()
 }
 
 // Define your mock service implementation as needed. For example:
@@ -114,5 +331,5 @@ func main() {
 //     Registry *MockRegistry
 // }
 // func (s *MyMockServer) MyMethod(ctx context.Context, req *mypb.MyRequest) (*mypb.MyResponse, error) {
-//     return s.Registry.GetResponse(req)
+//     return s.Registry.GetResponse(ctx, "/mypb.MyService/MyMethod", req)
 // }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// loadMappingFile reads a hash->response-file mapping JSON file, the same
+// format LoadRegistry expects, returning an empty mapping if path is empty.
+func loadMappingFile(path string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if path == "" {
+		return mapping, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mapping, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// persistMappingAtomic writes mapping to path via a temp-file-plus-rename so
+// concurrent readers never observe a half-written file.
+func persistMappingAtomic(path string, mapping map[string]string) error {
+	data, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".mapping-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// recordResponse persists resp as a new golden file and appends it to the
+// registry's mapping, guarded by r.mappingMu since multiple RPCs can race to
+// record at once - and since that's the same lock responseFromHash takes to
+// read r.Mapping, recording can never be observed as a torn map access.
+func (r *MockRegistry) recordResponse(mappingPath string, req, resp proto.Message, outputType protoreflect.FullName) error {
+	reqJSON, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(reqJSON))
+	filename := fmt.Sprintf("%s.%s.json", hash, outputType)
+
+	respJSON, err := protojson.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	r.mappingMu.Lock()
+	defer r.mappingMu.Unlock()
+
+	if err := os.WriteFile(filepath.Join(r.ResponseDir, filename), respJSON, 0o644); err != nil {
+		return err
+	}
+	r.Mapping[hash] = filename
+	r.cache.Store(hash, resp)
+	return persistMappingAtomic(mappingPath, r.Mapping)
+}
+
+// RecordingUnknownServiceHandler builds a grpc.UnknownServiceHandler that
+// serves known requests out of registry exactly like
+// DynamicUnknownServiceHandler, but on a miss transparently proxies the call
+// to upstream, captures the response as a new golden file, and appends it to
+// the mapping so the next call is served from disk. Only unary RPCs are
+// supported in record mode. cache is applied around the registry lookup the
+// same way serveUnary applies it; see that function's doc comment.
+func RecordingUnknownServiceHandler(registry *MockRegistry, files *protoregistry.Files, upstream *grpc.ClientConn, mappingPath string, cache *CacheMiddleware) func(srv interface{}, stream grpc.ServerStream) error {
+	return func(srv interface{}, stream grpc.ServerStream) error {
+		fullMethod, ok := grpc.MethodFromServerStream(stream)
+		if !ok {
+			return status.Error(codes.Internal, "could not determine method from stream")
+		}
+		service, method := splitFullMethod(fullMethod)
+
+		methodDesc, err := findMethodDescriptor(files, service, method)
+		if err != nil {
+			return status.Error(codes.Unimplemented, err.Error())
+		}
+		if methodDesc.IsStreamingClient() || methodDesc.IsStreamingServer() {
+			return status.Errorf(codes.Unimplemented, "record mode only supports unary RPCs, got %s", fullMethod)
+		}
+
+		var reqFrame rawFrame
+		if err := stream.RecvMsg(&reqFrame); err != nil {
+			return err
+		}
+		reqMsg := dynamicpb.NewMessage(methodDesc.Input())
+		if err := proto.Unmarshal(reqFrame.payload, reqMsg); err != nil {
+			return status.Errorf(codes.InvalidArgument, "decoding request: %v", err)
+		}
+
+		dispatch := func() (proto.Message, error) {
+			return registry.GetResponse(stream.Context(), fullMethod, reqMsg)
+		}
+		var resp proto.Message
+		if cache != nil {
+			resp, err = cache.Resolve(fullMethod, methodDesc, reqMsg, dispatch)
+		} else {
+			resp, err = dispatch()
+		}
+		if err == nil {
+			respBytes, marshalErr := proto.Marshal(resp)
+			if marshalErr != nil {
+				return marshalErr
+			}
+			return stream.SendMsg(&rawFrame{payload: respBytes})
+		}
+
+		var upstreamResp rawFrame
+		if err := upstream.Invoke(stream.Context(), fullMethod, &reqFrame, &upstreamResp, grpc.CallContentSubtype(rawCodecName)); err != nil {
+			return err
+		}
+		respMsg := dynamicpb.NewMessage(methodDesc.Output())
+		if err := proto.Unmarshal(upstreamResp.payload, respMsg); err != nil {
+			return err
+		}
+
+		if err := registry.recordResponse(mappingPath, reqMsg, respMsg, methodDesc.Output().FullName()); err != nil {
+			log.Printf("record: failed to persist response for %s: %v", fullMethod, err)
+		}
+		return stream.SendMsg(&upstreamResp)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TestRegistryMappingConcurrentAccess exercises recordResponse and
+// responseFromHash concurrently, the way -record mode does under real
+// traffic: every RPC reads r.Mapping while recordResponse may be writing to
+// it. Before mappingMu guarded both sides this was a data race (run with
+// -race to see it reproduce against an unguarded map).
+func TestRegistryMappingConcurrentAccess(t *testing.T) {
+	files := buildTestFiles(t)
+	methodDesc := testMethodDesc(t, files)
+
+	dir := t.TempDir()
+	registry := &MockRegistry{
+		Mapping:     map[string]string{},
+		ResponseDir: dir,
+		ResponseTypes: map[string]proto.Message{
+			string(methodDesc.Output().FullName()): dynamicpb.NewMessage(methodDesc.Output()),
+		},
+	}
+	mappingPath := filepath.Join(dir, "mapping.json")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := dynamicpb.NewMessage(methodDesc.Input())
+			req.Set(methodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString(fmt.Sprintf("user-%d", i)))
+
+			resp := dynamicpb.NewMessage(methodDesc.Output())
+			resp.Set(methodDesc.Output().Fields().ByName("msg"), protoreflect.ValueOfString("ok"))
+
+			if err := registry.recordResponse(mappingPath, req, resp, methodDesc.Output().FullName()); err != nil {
+				t.Errorf("recordResponse: %v", err)
+				return
+			}
+			// recordResponse also caches resp; drop it so responseFromHash
+			// has to read r.Mapping rather than return from the cache.
+			hash := requestHash(req)
+			registry.cache.Delete(hash)
+			if _, err := registry.responseFromHash(hash); err != nil {
+				t.Errorf("responseFromHash: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestRecordingProxiesToUpstream drives a real proxied call through
+// RecordingUnknownServiceHandler against a real upstream grpc.Server, the way
+// -record mode does in production. Before the fix that added
+// grpc.CallContentSubtype(rawCodecName) to both the upstream.Invoke call and
+// the upstream grpc.Dial, this always failed: grpc-go fell back to its
+// built-in "proto" codec, which rejects *rawFrame with "message is
+// *main.rawFrame, want proto.Message" before the call ever reached upstream.
+func TestRecordingProxiesToUpstream(t *testing.T) {
+	files := buildTestFiles(t)
+	methodDesc := testMethodDesc(t, files)
+	fullMethod := "/testpkg.TestService/Get"
+
+	upstreamRegistry := &MockRegistry{Stubs: NewStubStore(), ResponseTypes: map[string]proto.Message{}, Files: files}
+	upstreamRegistry.RegisterDynamicTypes(files)
+	upstreamRegistry.Stubs.Add(&Stub{
+		Service: "testpkg.TestService",
+		Method:  "Get",
+		Output:  StubOutput{Data: json.RawMessage(`{"msg":"from-upstream"}`)},
+	})
+
+	upstreamLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	upstreamServer := grpc.NewServer(grpc.UnknownServiceHandler(DynamicUnknownServiceHandler(upstreamRegistry, files, nil)))
+	go upstreamServer.Serve(upstreamLis)
+	defer upstreamServer.Stop()
+
+	upstreamConn, err := grpc.Dial(upstreamLis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rawCodecName)),
+	)
+	if err != nil {
+		t.Fatalf("dial upstream: %v", err)
+	}
+	defer upstreamConn.Close()
+
+	dir := t.TempDir()
+	mappingPath := filepath.Join(dir, "mapping.json")
+	recordingRegistry := &MockRegistry{
+		Mapping:       map[string]string{},
+		ResponseDir:   dir,
+		ResponseTypes: map[string]proto.Message{},
+		Stubs:         NewStubStore(),
+		Files:         files,
+	}
+	recordingRegistry.RegisterDynamicTypes(files)
+
+	recordingLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	recordingServer := grpc.NewServer(grpc.UnknownServiceHandler(
+		RecordingUnknownServiceHandler(recordingRegistry, files, upstreamConn, mappingPath, nil),
+	))
+	go recordingServer.Serve(recordingLis)
+	defer recordingServer.Stop()
+
+	clientConn, err := grpc.Dial(recordingLis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rawCodecName)),
+	)
+	if err != nil {
+		t.Fatalf("dial recording server: %v", err)
+	}
+	defer clientConn.Close()
+
+	req := dynamicpb.NewMessage(methodDesc.Input())
+	req.Set(methodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString("abc"))
+
+	resp := dynamicpb.NewMessage(methodDesc.Output())
+	invokeDynamic(t, clientConn, fullMethod, req, resp)
+	if got := resp.Get(methodDesc.Output().Fields().ByName("msg")).String(); got != "from-upstream" {
+		t.Fatalf("resp.msg = %q, want %q", got, "from-upstream")
+	}
+
+	if len(recordingRegistry.Mapping) != 1 {
+		t.Fatalf("Mapping has %d entries after proxying, want 1 (recordResponse never ran)", len(recordingRegistry.Mapping))
+	}
+	if _, err := os.ReadFile(mappingPath); err != nil {
+		t.Fatalf("reading persisted mapping file: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/tkoberle/golang-samples/mock-grpc-server/cachepolicy"
+)
+
+// StreamEntry is one message in an ordered server-streaming (or bidi) reply:
+// a response file plus an optional delay before it is sent.
+type StreamEntry struct {
+	File    string `json:"file"`
+	DelayMs int    `json:"delay_ms,omitempty"`
+}
+
+// StreamMapping is a server-streaming mapping entry: the ordered messages to
+// send for a given request hash, followed by a terminal status.
+type StreamMapping struct {
+	Messages []StreamEntry `json:"messages"`
+	Status   *StubError    `json:"status,omitempty"`
+}
+
+// StreamMessage is a resolved, ready-to-send streaming response.
+type StreamMessage struct {
+	Response proto.Message
+	DelayMs  int
+}
+
+// BidiRule sends a batch of messages once the client's OnMessage'th message
+// has been received.
+type BidiRule struct {
+	OnMessage int           `json:"on_message"`
+	Send      []StreamEntry `json:"send"`
+}
+
+// BidiScript scripts a bidirectional-streaming exchange for one method.
+type BidiScript struct {
+	Method string     `json:"method"`
+	Rules  []BidiRule `json:"rules"`
+}
+
+// LoadStreamMapping reads a JSON file mapping request hash to StreamMapping,
+// in the same spirit as the plain hash->file Mapping used for unary mocks.
+func LoadStreamMapping(path string) (map[string]StreamMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mapping map[string]StreamMapping
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, err
+	}
+	return mapping, nil
+}
+
+// LoadBidiScripts reads a directory of JSON BidiScript files, keyed by their
+// Method field ("service.method").
+func LoadBidiScripts(dir string) (map[string]*BidiScript, error) {
+	scripts := make(map[string]*BidiScript)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var script BidiScript
+		if err := json.Unmarshal(data, &script); err != nil {
+			return fmt.Errorf("parsing bidi script %s: %w", path, err)
+		}
+		scripts[script.Method] = &script
+		return nil
+	})
+	return scripts, err
+}
+
+// loadStreamEntry reads entry.File from r.ResponseDir and decodes it into a
+// fresh clone of typeTemplate.
+func (r *MockRegistry) loadStreamEntry(entry StreamEntry, typeTemplate proto.Message) (proto.Message, error) {
+	if typeTemplate == nil {
+		return nil, fmt.Errorf("no response type available for stream file %s", entry.File)
+	}
+	data, err := os.ReadFile(filepath.Join(r.ResponseDir, entry.File))
+	if err != nil {
+		return nil, err
+	}
+	response := proto.Clone(typeTemplate)
+	if err := protojson.Unmarshal(data, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// GetStreamResponses resolves the ordered messages and terminal status for a
+// server-streaming request. The stub matcher engine is tried first, exactly
+// as GetResponse tries it for unary calls, so a stub's "stream" output block
+// can drive a server-streaming response; falling back to the legacy
+// hash->StreamMapping mapping for backward compatibility.
+func (r *MockRegistry) GetStreamResponses(ctx context.Context, fullMethod string, req proto.Message) ([]StreamMessage, *StubError, error) {
+	jsonBytes, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	service, method := splitFullMethod(fullMethod)
+	typeTemplate := r.outputTypeFor(service, method)
+
+	if r.Stubs != nil {
+		fields := flattenJSONFields(jsonBytes)
+		md, _ := metadata.FromIncomingContext(ctx)
+		if stub, ok := r.Stubs.Match(service, method, fields, md); ok {
+			return r.streamFromStub(stub, typeTemplate)
+		}
+	}
+
+	hash := fmt.Sprintf("%x", sha256.Sum256(jsonBytes))
+	mapping, ok := r.StreamMapping[hash]
+	if !ok {
+		return nil, nil, fmt.Errorf("no stream mapping found for hash: %s", hash)
+	}
+
+	messages := make([]StreamMessage, 0, len(mapping.Messages))
+	for _, entry := range mapping.Messages {
+		resp, err := r.loadStreamEntry(entry, typeTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, StreamMessage{Response: resp, DelayMs: entry.DelayMs})
+	}
+	return messages, mapping.Status, nil
+}
+
+// streamFromStub renders a matched stub's "stream" output block as the
+// ordered messages for a server-streaming call, the streaming counterpart of
+// stubResponse.
+func (r *MockRegistry) streamFromStub(stub *Stub, typeTemplate proto.Message) ([]StreamMessage, *StubError, error) {
+	if stub.Output.Error != nil {
+		return nil, stub.Output.Error, nil
+	}
+	messages := make([]StreamMessage, 0, len(stub.Output.Stream))
+	for _, raw := range stub.Output.Stream {
+		if typeTemplate == nil {
+			return nil, nil, fmt.Errorf("no response type registered for stub %s/%s", stub.Service, stub.Method)
+		}
+		resp := proto.Clone(typeTemplate)
+		if err := protojson.Unmarshal(raw, resp); err != nil {
+			return nil, nil, err
+		}
+		messages = append(messages, StreamMessage{Response: resp})
+	}
+	return messages, nil, nil
+}
+
+// GetClientStreamResponse accumulates a client-streaming call's messages,
+// hashes their concatenation, and resolves a single response from the legacy
+// hash mapping via responseFromHash. Unlike GetResponse, it does not consult
+// stubs.
+func (r *MockRegistry) GetClientStreamResponse(ctx context.Context, fullMethod string, reqs []proto.Message) (proto.Message, error) {
+	var all strings.Builder
+	for _, req := range reqs {
+		jsonBytes, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		all.Write(jsonBytes)
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(all.String())))
+	return r.responseFromHash(hash)
+}
+
+// GetBidiScript returns the scripted exchange for fullMethod, if any.
+func (r *MockRegistry) GetBidiScript(fullMethod string) (*BidiScript, bool) {
+	service, method := splitFullMethod(fullMethod)
+	script, ok := r.BidiScripts[service+"."+method]
+	return script, ok
+}
+
+// serveUnary drives a plain unary RPC through the dynamic handler: one
+// request in, one response out via registry.GetResponse. cache, if non-nil,
+// is consulted via CacheMiddleware.Resolve around that dispatch: grpc-go
+// invokes only the stream interceptor chain for calls served through
+// grpc.UnknownServiceHandler (see CacheMiddleware.UnaryServerInterceptor's
+// doc comment), so applying cachepolicy here - at the actual dispatch point
+// for every dynamically-mocked unary call - is what makes accessor caching
+// and mutator invalidation take effect for them at all.
+func serveUnary(registry *MockRegistry, methodDesc protoreflect.MethodDescriptor, fullMethod string, stream grpc.ServerStream, cache *CacheMiddleware) error {
+	var reqFrame rawFrame
+	if err := stream.RecvMsg(&reqFrame); err != nil {
+		return err
+	}
+	reqMsg := dynamicpb.NewMessage(methodDesc.Input())
+	if err := proto.Unmarshal(reqFrame.payload, reqMsg); err != nil {
+		return status.Errorf(codes.InvalidArgument, "decoding request: %v", err)
+	}
+
+	dispatch := func() (proto.Message, error) {
+		return registry.GetResponse(stream.Context(), fullMethod, reqMsg)
+	}
+	var resp proto.Message
+	var err error
+	if cache != nil {
+		resp, err = cache.Resolve(fullMethod, methodDesc, reqMsg, dispatch)
+	} else {
+		resp, err = dispatch()
+	}
+	if err != nil {
+		return err
+	}
+	respBytes, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rawFrame{payload: respBytes})
+}
+
+// serveServerStream drives a server-streaming RPC: one request in, the
+// scripted messages out, then the scripted terminal status (OK if unset).
+func serveServerStream(registry *MockRegistry, methodDesc protoreflect.MethodDescriptor, fullMethod string, stream grpc.ServerStream) error {
+	var reqFrame rawFrame
+	if err := stream.RecvMsg(&reqFrame); err != nil {
+		return err
+	}
+	reqMsg := dynamicpb.NewMessage(methodDesc.Input())
+	if err := proto.Unmarshal(reqFrame.payload, reqMsg); err != nil {
+		return status.Errorf(codes.InvalidArgument, "decoding request: %v", err)
+	}
+
+	messages, terminal, err := registry.GetStreamResponses(stream.Context(), fullMethod, reqMsg)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if msg.DelayMs > 0 {
+			time.Sleep(time.Duration(msg.DelayMs) * time.Millisecond)
+		}
+		respBytes, err := proto.Marshal(msg.Response)
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(&rawFrame{payload: respBytes}); err != nil {
+			return err
+		}
+	}
+	if terminal != nil {
+		return status.Error(codes.Code(terminal.Code), terminal.Message)
+	}
+	return nil
+}
+
+// serveClientStream drives a client-streaming RPC: many requests in, one
+// response out once the client half-closes. cache, if non-nil and methodDesc
+// is a mutator, is invalidated once per inbound message, the same way
+// invalidatingServerStream.RecvMsg does for classically-registered services -
+// necessary here because that type's m.(proto.Message) assertion always
+// fails on this handler's *rawFrame messages, so CacheMiddleware.
+// StreamServerInterceptor alone never invalidates anything for dynamically-
+// mocked client streams.
+func serveClientStream(registry *MockRegistry, methodDesc protoreflect.MethodDescriptor, fullMethod string, stream grpc.ServerStream, cache *CacheMiddleware) error {
+	mutator := cache != nil && cache.policy.OpType(methodDesc) == cachepolicy.Mutator
+
+	var reqs []proto.Message
+	for {
+		var reqFrame rawFrame
+		err := stream.RecvMsg(&reqFrame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		reqMsg := dynamicpb.NewMessage(methodDesc.Input())
+		if err := proto.Unmarshal(reqFrame.payload, reqMsg); err != nil {
+			return status.Errorf(codes.InvalidArgument, "decoding request: %v", err)
+		}
+		if mutator {
+			cache.invalidate(fullMethod, reqMsg)
+		}
+		reqs = append(reqs, reqMsg)
+	}
+
+	resp, err := registry.GetClientStreamResponse(stream.Context(), fullMethod, reqs)
+	if err != nil {
+		return err
+	}
+	respBytes, err := proto.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&rawFrame{payload: respBytes})
+}
+
+// serveBidi drives a bidirectional-streaming RPC against a BidiScript: each
+// inbound message may trigger zero or more scripted outbound messages. cache
+// is consulted for mutator invalidation per inbound message the same way
+// serveClientStream does; see that function's doc comment for why.
+func serveBidi(registry *MockRegistry, methodDesc protoreflect.MethodDescriptor, fullMethod string, stream grpc.ServerStream, cache *CacheMiddleware) error {
+	script, ok := registry.GetBidiScript(fullMethod)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "no bidi script registered for %s", fullMethod)
+	}
+	typeTemplate := dynamicpb.NewMessage(methodDesc.Output())
+	mutator := cache != nil && cache.policy.OpType(methodDesc) == cachepolicy.Mutator
+
+	received := 0
+	for {
+		var reqFrame rawFrame
+		err := stream.RecvMsg(&reqFrame)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		received++
+
+		if mutator {
+			reqMsg := dynamicpb.NewMessage(methodDesc.Input())
+			if err := proto.Unmarshal(reqFrame.payload, reqMsg); err != nil {
+				return status.Errorf(codes.InvalidArgument, "decoding request: %v", err)
+			}
+			cache.invalidate(fullMethod, reqMsg)
+		}
+
+		for _, rule := range script.Rules {
+			if rule.OnMessage != received {
+				continue
+			}
+			for _, entry := range rule.Send {
+				resp, err := registry.loadStreamEntry(entry, typeTemplate)
+				if err != nil {
+					return err
+				}
+				if entry.DelayMs > 0 {
+					time.Sleep(time.Duration(entry.DelayMs) * time.Millisecond)
+				}
+				respBytes, err := proto.Marshal(resp)
+				if err != nil {
+					return err
+				}
+				if err := stream.SendMsg(&rawFrame{payload: respBytes}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
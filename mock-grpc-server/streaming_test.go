@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/tkoberle/golang-samples/mock-grpc-server/cachepolicy"
+)
+
+// invokeClientStreamDynamic drives a client-streaming RPC the way a client
+// with no generated stub for it would, mirroring invokeDynamic.
+func invokeClientStreamDynamic(t *testing.T, conn *grpc.ClientConn, fullMethod string, reqs []proto.Message) error {
+	t.Helper()
+	stream, err := conn.NewStream(context.Background(), &grpc.StreamDesc{ClientStreams: true}, fullMethod)
+	if err != nil {
+		t.Fatalf("opening client stream: %v", err)
+	}
+	for _, req := range reqs {
+		reqBytes, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatalf("marshal request: %v", err)
+		}
+		if err := stream.SendMsg(&rawFrame{payload: reqBytes}); err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	var respFrame rawFrame
+	return stream.RecvMsg(&respFrame)
+}
+
+// TestDynamicClientStreamMutatorInvalidatesViaRealHandler proves a
+// client-streaming mutator served through the real DynamicUnknownServiceHandler
+// wiring invalidates its accessor's cached response, the way serveUnary
+// already did for unary mutators (bd757cf). Before this fix, serveClientStream
+// never consulted CacheMiddleware at all, so a cached accessor response
+// outlived a mutator call that should have evicted it.
+func TestDynamicClientStreamMutatorInvalidatesViaRealHandler(t *testing.T) {
+	files := buildMutatorTestFiles(t)
+	methodDesc := testMethodDesc(t, files)
+	getFullMethod := "/testpkg.TestService/Get"
+	updateFullMethod := "/testpkg.TestService/Update"
+
+	updateMethodDesc, err := findMethodDescriptor(files, "testpkg.TestService", "Update")
+	if err != nil {
+		t.Fatalf("finding Update method descriptor: %v", err)
+	}
+
+	dir := t.TempDir()
+	registry := &MockRegistry{
+		Mapping:       map[string]string{},
+		ResponseDir:   dir,
+		ResponseTypes: map[string]proto.Message{},
+		Stubs:         NewStubStore(),
+		Files:         files,
+	}
+	registry.RegisterDynamicTypes(files)
+	registry.Stubs.Add(&Stub{
+		Service: "testpkg.TestService",
+		Method:  "Get",
+		Output:  StubOutput{Data: json.RawMessage(`{"msg":"hello"}`)},
+	})
+
+	// Seed the legacy hash mapping Update's GetClientStreamResponse resolves
+	// from, so the mutator call itself succeeds end-to-end too. retries is
+	// set here (and left unset on getReq) purely so the two requests hash
+	// differently despite sharing a scope - otherwise Update's response would
+	// collide into the same registry.cache slot responseFromHash just evicted
+	// for Get, and this test couldn't tell a real eviction from a collision.
+	updateReq := dynamicpb.NewMessage(updateMethodDesc.Input())
+	updateReq.Set(updateMethodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString("abc"))
+	updateReq.Set(updateMethodDesc.Input().Fields().ByName("retries"), protoreflect.ValueOfInt32(1))
+	updateReqJSON, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(updateReq)
+	if err != nil {
+		t.Fatalf("marshaling update request: %v", err)
+	}
+	updateHash := fmt.Sprintf("%x", sha256.Sum256(updateReqJSON))
+	updateFilename := fmt.Sprintf("%s.%s.json", updateHash, updateMethodDesc.Output().FullName())
+	if err := os.WriteFile(filepath.Join(dir, updateFilename), []byte(`{"msg":"updated"}`), 0o644); err != nil {
+		t.Fatalf("writing update golden file: %v", err)
+	}
+	registry.Mapping[updateHash] = updateFilename
+
+	policy := cachepolicy.NewPolicy(files)
+	groups := map[string]cachepolicy.InvalidationGroup{
+		"testpkg.TestService.Update": {
+			ScopeField: "user_id",
+			Accessors:  []string{"testpkg.TestService.Get"},
+		},
+	}
+	for mutator, group := range groups {
+		policy.RegisterInvalidationGroup(mutator, group)
+	}
+	cache := NewCacheMiddleware(registry, policy, files, groups)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := grpc.NewServer(grpc.UnknownServiceHandler(DynamicUnknownServiceHandler(registry, files, cache)))
+	go server.Serve(lis)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rawCodecName)),
+	)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	getReq := dynamicpb.NewMessage(methodDesc.Input())
+	getReq.Set(methodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString("abc"))
+
+	resp1 := dynamicpb.NewMessage(methodDesc.Output())
+	invokeDynamic(t, conn, getFullMethod, getReq, resp1)
+	if hits, misses, _ := cache.Metrics(); hits != 0 || misses != 1 {
+		t.Fatalf("after first Get: hits=%d misses=%d, want hits=0 misses=1", hits, misses)
+	}
+
+	resp2 := dynamicpb.NewMessage(methodDesc.Output())
+	invokeDynamic(t, conn, getFullMethod, getReq, resp2)
+	if hits, misses, _ := cache.Metrics(); hits != 1 || misses != 1 {
+		t.Fatalf("after second (cached) Get: hits=%d misses=%d, want hits=1 misses=1", hits, misses)
+	}
+
+	if err := invokeClientStreamDynamic(t, conn, updateFullMethod, []proto.Message{updateReq}); err != nil {
+		t.Fatalf("invoking Update: %v", err)
+	}
+	if _, _, invalidations := cache.Metrics(); invalidations != 1 {
+		t.Fatalf("invalidations after Update = %d, want 1", invalidations)
+	}
+
+	resp3 := dynamicpb.NewMessage(methodDesc.Output())
+	invokeDynamic(t, conn, getFullMethod, getReq, resp3)
+	if hits, misses, _ := cache.Metrics(); hits != 1 || misses != 2 {
+		t.Fatalf("after Get following invalidation: hits=%d misses=%d, want hits=1 misses=2 (cache must have been evicted)", hits, misses)
+	}
+}
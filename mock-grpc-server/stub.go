@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// FieldMatcher describes how a set of string-keyed fields (proto fields or
+// gRPC metadata) must look for a stub to apply. All three sub-blocks are
+// ANDed together, and within a sub-block every key must match.
+type FieldMatcher struct {
+	Equals   map[string]string `json:"equals,omitempty" yaml:"equals,omitempty"`
+	Contains map[string]string `json:"contains,omitempty" yaml:"contains,omitempty"`
+	Matches  map[string]string `json:"matches,omitempty" yaml:"matches,omitempty"`
+}
+
+func (m FieldMatcher) matches(fields map[string]string) bool {
+	for k, want := range m.Equals {
+		if fields[k] != want {
+			return false
+		}
+	}
+	for k, want := range m.Contains {
+		if !strings.Contains(fields[k], want) {
+			return false
+		}
+	}
+	for k, pattern := range m.Matches {
+		re, err := regexp.Compile(pattern)
+		if err != nil || !re.MatchString(fields[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// StubError describes a canned gRPC failure a stub should return instead of
+// a successful response.
+type StubError struct {
+	Code    int32  `json:"code" yaml:"code"`
+	Message string `json:"message" yaml:"message"`
+}
+
+// StubOutput is the response a matching stub produces. Exactly one of Data,
+// Error, or Stream should be set; Data and Stream are proto JSON. Data (and
+// Error) drive a unary response; Stream drives a server-streaming response,
+// one message per entry, via MockRegistry.streamFromStub. Client-streaming
+// calls are resolved from the hash mapping only and do not consult stubs.
+type StubOutput struct {
+	Data   json.RawMessage   `json:"data,omitempty" yaml:"data,omitempty"`
+	Error  *StubError        `json:"error,omitempty" yaml:"error,omitempty"`
+	Stream []json.RawMessage `json:"stream,omitempty" yaml:"stream,omitempty"`
+}
+
+// Stub is a single gripmock-style expectation: when a request to
+// Service/Method satisfies Input (and Headers, if set), Output is returned.
+// Priority breaks ties when more than one stub matches; higher wins.
+type Stub struct {
+	Service  string       `json:"service" yaml:"service"`
+	Method   string       `json:"method" yaml:"method"`
+	Priority int          `json:"priority" yaml:"priority"`
+	Input    FieldMatcher `json:"input" yaml:"input"`
+	Headers  FieldMatcher `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Output   StubOutput   `json:"output" yaml:"output"`
+}
+
+// StubStore holds the set of declared stubs and matches incoming requests
+// against them. It is safe for concurrent use.
+type StubStore struct {
+	mu    sync.RWMutex
+	stubs []*Stub
+}
+
+// NewStubStore returns an empty StubStore.
+func NewStubStore() *StubStore {
+	return &StubStore{}
+}
+
+// LoadDir walks dir and loads every *.json, *.yaml, and *.yml file as either
+// a single Stub or a JSON/YAML array of stubs.
+func (s *StubStore) LoadDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".json", ".yaml", ".yml":
+		default:
+			return nil
+		}
+		stubs, err := loadStubFile(path)
+		if err != nil {
+			return fmt.Errorf("loading stub file %s: %w", path, err)
+		}
+		s.mu.Lock()
+		s.stubs = append(s.stubs, stubs...)
+		s.mu.Unlock()
+		return nil
+	})
+}
+
+func loadStubFile(path string) ([]*Stub, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, err
+		}
+	}
+
+	// A file may contain either one stub or an array of stubs.
+	var multi []*Stub
+	if err := json.Unmarshal(data, &multi); err == nil {
+		return multi, nil
+	}
+	var single Stub
+	if err := json.Unmarshal(data, &single); err != nil {
+		return nil, err
+	}
+	return []*Stub{&single}, nil
+}
+
+// Add registers a stub at runtime, e.g. from the admin endpoint.
+func (s *StubStore) Add(stub *Stub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stubs = append(s.stubs, stub)
+}
+
+// List returns a snapshot of the currently registered stubs.
+func (s *StubStore) List() []*Stub {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*Stub, len(s.stubs))
+	copy(out, s.stubs)
+	return out
+}
+
+// Clear removes every registered stub.
+func (s *StubStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stubs = nil
+}
+
+// Match returns the highest-priority stub whose Input and Headers matchers
+// are satisfied by fields and md, for the given service/method pair.
+func (s *StubStore) Match(service, method string, fields map[string]string, md metadata.MD) (*Stub, bool) {
+	s.mu.RLock()
+	candidates := make([]*Stub, len(s.stubs))
+	copy(candidates, s.stubs)
+	s.mu.RUnlock()
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority > candidates[j].Priority
+	})
+
+	headerFields := flattenMetadata(md)
+	for _, stub := range candidates {
+		if stub.Service != service || stub.Method != method {
+			continue
+		}
+		if !stub.Input.matches(fields) {
+			continue
+		}
+		if !stub.Headers.matches(headerFields) {
+			continue
+		}
+		return stub, true
+	}
+	return nil, false
+}
+
+func flattenMetadata(md metadata.MD) map[string]string {
+	fields := make(map[string]string, len(md))
+	for k, values := range md {
+		fields[k] = strings.Join(values, ",")
+	}
+	return fields
+}
+
+// adminServer exposes the StubStore over HTTP so tests can register
+// expectations without restarting the mock server, plus the cache middleware's
+// hit/miss/invalidation counters when -descriptor-set enables one.
+type adminServer struct {
+	store *StubStore
+	cache *CacheMiddleware // nil unless -descriptor-set is set
+}
+
+func newAdminServer(store *StubStore, cache *CacheMiddleware) *adminServer {
+	return &adminServer{store: store, cache: cache}
+}
+
+func (a *adminServer) handleStubs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.store.List())
+	case http.MethodPost:
+		var stub Stub
+		if err := json.NewDecoder(r.Body).Decode(&stub); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.store.Add(&stub)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		a.store.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cacheMetrics is the JSON shape returned by handleCacheMetrics.
+type cacheMetrics struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+func (a *adminServer) handleCacheMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.cache == nil {
+		http.Error(w, "cache invalidation is not enabled (no -descriptor-set)", http.StatusNotFound)
+		return
+	}
+	hits, misses, invalidations := a.cache.Metrics()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cacheMetrics{Hits: hits, Misses: misses, Invalidations: invalidations})
+}
+
+// Handler returns the HTTP handler to mount on an admin listener, typically
+// under "/stubs" and "/cache-metrics".
+func (a *adminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stubs", a.handleStubs)
+	mux.HandleFunc("/cache-metrics", a.handleCacheMetrics)
+	return mux
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TestGetResponseMatchesNonStringFields reproduces the exact failure mode
+// from the review: a request with a non-string top-level field (here,
+// retries int32) used to make json.Unmarshal into map[string]string fail
+// outright, silently making every equals/contains/matches rule unmatchable.
+func TestGetResponseMatchesNonStringFields(t *testing.T) {
+	files := buildTestFiles(t)
+	methodDesc := testMethodDesc(t, files)
+
+	req := dynamicpb.NewMessage(methodDesc.Input())
+	req.Set(methodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString("abc"))
+	req.Set(methodDesc.Input().Fields().ByName("retries"), protoreflect.ValueOfInt32(3))
+
+	registry := &MockRegistry{Stubs: NewStubStore(), ResponseTypes: map[string]proto.Message{}, Files: files}
+	registry.RegisterDynamicTypes(files)
+	registry.Stubs.Add(&Stub{
+		Service: "testpkg.TestService",
+		Method:  "Get",
+		Input: FieldMatcher{
+			Equals: map[string]string{"user_id": "abc", "retries": "3"},
+		},
+		Output: StubOutput{Data: json.RawMessage(`{"msg":"matched"}`)},
+	})
+
+	resp, err := registry.GetResponse(context.Background(), "/testpkg.TestService/Get", req)
+	if err != nil {
+		t.Fatalf("GetResponse: %v", err)
+	}
+	if got := resp.ProtoReflect().Get(methodDesc.Output().Fields().ByName("msg")).String(); got != "matched" {
+		t.Fatalf("resp.msg = %q, want %q", got, "matched")
+	}
+}
+
+// TestGetStreamResponsesFromStub is the regression test for 37168b3: a stub's
+// "stream" output block must drive GetStreamResponses/streamFromStub the same
+// way Data drives a unary response, one StreamMessage per entry in order.
+func TestGetStreamResponsesFromStub(t *testing.T) {
+	files := buildTestFiles(t)
+	methodDesc := testMethodDesc(t, files)
+
+	req := dynamicpb.NewMessage(methodDesc.Input())
+	req.Set(methodDesc.Input().Fields().ByName("user_id"), protoreflect.ValueOfString("abc"))
+
+	registry := &MockRegistry{Stubs: NewStubStore(), ResponseTypes: map[string]proto.Message{}, Files: files}
+	registry.RegisterDynamicTypes(files)
+	registry.Stubs.Add(&Stub{
+		Service: "testpkg.TestService",
+		Method:  "Get",
+		Input: FieldMatcher{
+			Equals: map[string]string{"user_id": "abc"},
+		},
+		Output: StubOutput{Stream: []json.RawMessage{
+			json.RawMessage(`{"msg":"first"}`),
+			json.RawMessage(`{"msg":"second"}`),
+		}},
+	})
+
+	messages, terminal, err := registry.GetStreamResponses(context.Background(), "/testpkg.TestService/Get", req)
+	if err != nil {
+		t.Fatalf("GetStreamResponses: %v", err)
+	}
+	if terminal != nil {
+		t.Fatalf("terminal status = %+v, want nil", terminal)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("len(messages) = %d, want 2", len(messages))
+	}
+	msgField := methodDesc.Output().Fields().ByName("msg")
+	if got := messages[0].Response.ProtoReflect().Get(msgField).String(); got != "first" {
+		t.Fatalf("messages[0].msg = %q, want %q", got, "first")
+	}
+	if got := messages[1].Response.ProtoReflect().Get(msgField).String(); got != "second" {
+		t.Fatalf("messages[1].msg = %q, want %q", got, "second")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// buildTestFiles hand-builds a protoregistry.Files describing
+// testpkg.TestService, a unary Get(Req) returns (Resp) method, via
+// descriptorpb directly so these tests don't depend on protoc being
+// available in the sandbox.
+func buildTestFiles(t *testing.T) *protoregistry.Files {
+	t.Helper()
+
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+			JsonName: proto.String(name),
+		}
+	}
+
+	fdProto := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("testpkg"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Req"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("user_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("retries", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				},
+			},
+			{
+				Name: proto.String("Resp"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("msg", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{
+				Name: proto.String("TestService"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{
+						Name:       proto.String("Get"),
+						InputType:  proto.String(".testpkg.Req"),
+						OutputType: proto.String(".testpkg.Resp"),
+					},
+				},
+			},
+		},
+	}
+
+	fd, err := protodesc.NewFile(fdProto, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("building test file descriptor: %v", err)
+	}
+	files := new(protoregistry.Files)
+	if err := files.RegisterFile(fd); err != nil {
+		t.Fatalf("registering test file descriptor: %v", err)
+	}
+	return files
+}
+
+func testMethodDesc(t *testing.T, files *protoregistry.Files) protoreflect.MethodDescriptor {
+	t.Helper()
+	md, err := findMethodDescriptor(files, "testpkg.TestService", "Get")
+	if err != nil {
+		t.Fatalf("finding test method descriptor: %v", err)
+	}
+	return md
+}
+
+// buildMutatorTestFiles extends buildTestFiles with a real (mock.op_type)
+// MUTATOR annotation on a client-streaming Update method, the way a user's
+// own compiled descriptor set would carry it after importing
+// cachepolicy/policy.proto - so tests can exercise cachepolicy.Policy.OpType
+// resolution for real instead of relying on its Accessor default.
+func buildMutatorTestFiles(t *testing.T) *protoregistry.Files {
+	t.Helper()
+
+	mockFdProto := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("mock.proto"),
+		Package:    proto.String("mock"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/descriptor.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{
+			{
+				Name: proto.String("OpType"),
+				Value: []*descriptorpb.EnumValueDescriptorProto{
+					{Name: proto.String("ACCESSOR"), Number: proto.Int32(0)},
+					{Name: proto.String("MUTATOR"), Number: proto.Int32(1)},
+				},
+			},
+		},
+		Extension: []*descriptorpb.FieldDescriptorProto{
+			{
+				Name:     proto.String("op_type"),
+				Number:   proto.Int32(50000),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum(),
+				TypeName: proto.String(".mock.OpType"),
+				Extendee: proto.String(".google.protobuf.MethodOptions"),
+			},
+		},
+	}
+	mockFd, err := protodesc.NewFile(mockFdProto, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("building mock.proto descriptor: %v", err)
+	}
+
+	files := new(protoregistry.Files)
+	if err := files.RegisterFile(mockFd); err != nil {
+		t.Fatalf("registering mock.proto descriptor: %v", err)
+	}
+
+	extDesc, err := files.FindDescriptorByName("mock.op_type")
+	if err != nil {
+		t.Fatalf("finding mock.op_type extension: %v", err)
+	}
+	extType := dynamicpb.NewExtensionType(extDesc.(protoreflect.ExtensionDescriptor))
+
+	mutatorOpts := &descriptorpb.MethodOptions{}
+	proto.SetExtension(mutatorOpts, extType, protoreflect.EnumNumber(1)) // mock.OpType.MUTATOR
+
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+			JsonName: proto.String(name),
+		}
+	}
+
+	testFdProto := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test_mutator.proto"),
+		Package:    proto.String("testpkg"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"mock.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Req"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("user_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+					field("retries", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				},
+			},
+			{
+				Name: proto.String("Resp"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("msg", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{
+				Name: proto.String("TestService"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{
+						Name:       proto.String("Get"),
+						InputType:  proto.String(".testpkg.Req"),
+						OutputType: proto.String(".testpkg.Resp"),
+					},
+					{
+						Name:            proto.String("Update"),
+						InputType:       proto.String(".testpkg.Req"),
+						OutputType:      proto.String(".testpkg.Resp"),
+						ClientStreaming: proto.Bool(true),
+						Options:         mutatorOpts,
+					},
+				},
+			},
+		},
+	}
+	testFd, err := protodesc.NewFile(testFdProto, files)
+	if err != nil {
+		t.Fatalf("building test_mutator.proto descriptor: %v", err)
+	}
+	if err := files.RegisterFile(testFd); err != nil {
+		t.Fatalf("registering test_mutator.proto descriptor: %v", err)
+	}
+	return files
+}
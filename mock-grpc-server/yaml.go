@@ -0,0 +1,17 @@
+package main
+
+import (
+	"encoding/json"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlToJSON converts YAML bytes to equivalent JSON bytes so stub files can
+// be parsed with the same json.Unmarshal logic regardless of source format.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}